@@ -12,6 +12,7 @@ import (
 	"errors"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/ClusterCockpit/cc-backend/pkg/log"
@@ -25,6 +26,8 @@ const (
 	AuthViaLocalPassword AuthSource = iota
 	AuthViaLDAP
 	AuthViaToken
+	AuthViaWebAuthn
+	AuthViaOIDC
 )
 
 type AuthType int
@@ -43,6 +46,11 @@ type User struct {
 	AuthSource AuthSource `json:"authSource"`
 	Email      string     `json:"email"`
 	Projects   []string   `json:"projects"`
+	// Scopes restricts what a token-issued session is allowed to do,
+	// independent of Roles. A nil/empty Scopes means "unrestricted"
+	// for backwards compatibility with sessions that predate scopes
+	// (interactive logins, tokens minted before this field existed).
+	Scopes     []string `json:"scopes,omitempty"`
 	Expiration time.Time
 }
 
@@ -55,6 +63,27 @@ func (u *User) HasProject(project string) bool {
 	return false
 }
 
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) HasScope(scope string) bool {
+	if len(u.Scopes) == 0 {
+		return true
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
 func GetUser(ctx context.Context) *User {
 	x := ctx.Value(ContextUserKey)
 	if x == nil {
@@ -76,13 +105,26 @@ const ContextUserKey ContextKey = "user"
 
 type Authentication struct {
 	db            *sqlx.DB
-	sessionStore  *sessions.CookieStore
+	sessionStore  sessions.Store
 	SessionMaxAge time.Duration
 
 	authenticators []Authenticator
 	LdapAuth       *LdapAuthenticator
 	JwtAuth        *JWTAuthenticator
 	LocalAuth      *LocalAuthenticator
+	WebAuthnAuth   *WebAuthnAuthenticator
+	OIDCAuth       *OIDCAuthenticator
+
+	// Policies is loaded from the "policies" config slot and applied by
+	// PolicyMiddleware at router setup so new endpoints inherit
+	// consistent role/scope enforcement by default.
+	Policies []Policy
+
+	// ChangePasswordURL, if set (via the "local" config section's
+	// "change_password_url"), makes Auth wrap onsuccess in
+	// EnforcePasswordRotation so a user with a pending forced rotation
+	// can't ride an existing session past it.
+	ChangePasswordURL string
 }
 
 func (auth *Authentication) AuthViaSession(
@@ -111,18 +153,27 @@ func (auth *Authentication) AuthViaSession(
 	} else {
 		return nil, errors.New("No key projects in session")
 	}
-	if val, ok := session.Values["projects"]; ok {
+	if val, ok := session.Values["roles"]; ok {
 		roles, _ = val.([]string)
 	} else {
 		return nil, errors.New("No key roles in session")
 	}
 
+	authSource := AuthSource(-1)
+	if val, ok := session.Values["authSource"]; ok {
+		if raw, ok := val.(string); ok {
+			if n, err := strconv.Atoi(raw); err == nil {
+				authSource = AuthSource(n)
+			}
+		}
+	}
+
 	return &User{
 		Username:   username,
 		Projects:   projects,
 		Roles:      roles,
 		AuthType:   AuthSession,
-		AuthSource: -1,
+		AuthSource: authSource,
 	}, nil
 }
 
@@ -132,21 +183,33 @@ func Init(db *sqlx.DB,
 	auth.db = db
 
 	sessKey := os.Getenv("SESSION_KEY")
+	var keyBytes []byte
 	if sessKey == "" {
 		log.Warn("environment variable 'SESSION_KEY' not set (will use non-persistent random key)")
-		bytes := make([]byte, 32)
-		if _, err := rand.Read(bytes); err != nil {
+		keyBytes = make([]byte, 32)
+		if _, err := rand.Read(keyBytes); err != nil {
 			log.Error("Error while initializing authentication -> failed to generate random bytes for session key")
 			return nil, err
 		}
-		auth.sessionStore = sessions.NewCookieStore(bytes)
 	} else {
-		bytes, err := base64.StdEncoding.DecodeString(sessKey)
+		var err error
+		keyBytes, err = base64.StdEncoding.DecodeString(sessKey)
 		if err != nil {
 			log.Error("Error while initializing authentication -> decoding session key failed")
 			return nil, err
 		}
-		auth.sessionStore = sessions.NewCookieStore(bytes)
+	}
+
+	sessionConfig, _ := configs["session"].(map[string]interface{})
+	if store, _ := sessionConfig["store"].(string); store == "cookie" {
+		auth.sessionStore = sessions.NewCookieStore(keyBytes)
+	} else {
+		dbStore, err := NewDBSessionStore(auth, keyBytes)
+		if err != nil {
+			log.Error("Error while initializing authentication -> db session store init failed")
+			return nil, err
+		}
+		auth.sessionStore = dbStore
 	}
 
 	auth.JwtAuth = &JWTAuthenticator{}
@@ -178,12 +241,43 @@ func Init(db *sqlx.DB,
 		auth.authenticators = append(auth.authenticators, jwtCookieSessionAuth)
 	}
 
+	localConfig, _ := configs["local"].(map[string]interface{})
 	auth.LocalAuth = &LocalAuthenticator{}
-	if err := auth.LocalAuth.Init(auth, nil); err != nil {
+	if err := auth.LocalAuth.Init(auth, localConfig); err != nil {
 		log.Error("Error while initializing authentication -> localAuth init failed")
 		return nil, err
 	}
 	auth.authenticators = append(auth.authenticators, auth.LocalAuth)
+	if url, ok := localConfig["change_password_url"].(string); ok {
+		auth.ChangePasswordURL = url
+	}
+
+	if config, ok := configs["webauthn"]; ok {
+		auth.WebAuthnAuth = &WebAuthnAuthenticator{}
+		if err := auth.WebAuthnAuth.Init(auth, config); err != nil {
+			log.Error("Error while initializing authentication -> webAuthnAuth init failed")
+			return nil, err
+		}
+		// Deliberately not added to auth.authenticators: WebAuthn can only
+		// be driven through its own BeginLogin/FinishLogin handlers, which
+		// verify the signed assertion themselves (see WebAuthnAuthenticator.CanLogin).
+	}
+
+	if config, ok := configs["oidc"]; ok {
+		auth.OIDCAuth = &OIDCAuthenticator{}
+		if err := auth.OIDCAuth.Init(auth, config); err != nil {
+			log.Error("Error while initializing authentication -> oidcAuth init failed")
+			return nil, err
+		}
+		auth.authenticators = append(auth.authenticators, auth.OIDCAuth)
+	}
+
+	policies, err := LoadPolicies(configs["policies"])
+	if err != nil {
+		log.Error("Error while initializing authentication -> loading authorization policies failed")
+		return nil, err
+	}
+	auth.Policies = policies
 
 	return auth, nil
 }
@@ -216,6 +310,25 @@ func (auth *Authentication) Login(
 				return
 			}
 
+			// A pending forced rotation (or an expired MaxAge password)
+			// must block the session at the login request itself -
+			// EnforcePasswordRotation only guards requests made with an
+			// *existing* session, which this request doesn't have yet.
+			// Fail closed: if we can't determine the rotation state, do
+			// not hand out a session on the strength of a guess.
+			if must, merr := auth.MustChangePassword(user.Username, user.AuthSource); merr != nil {
+				log.Errorf("auth: could not check password rotation flag for '%s': %s", user.Username, merr.Error())
+				onfailure(rw, r, errors.New("auth: could not verify password rotation status"))
+				return
+			} else if must {
+				if auth.ChangePasswordURL != "" {
+					http.Redirect(rw, r, auth.ChangePasswordURL, http.StatusFound)
+					return
+				}
+				onfailure(rw, r, errors.New("auth: password change required before a session can be issued"))
+				return
+			}
+
 			session, err := auth.sessionStore.New(r, "session")
 			if err != nil {
 				log.Errorf("session creation failed: %s", err.Error())
@@ -229,6 +342,7 @@ func (auth *Authentication) Login(
 			session.Values["username"] = user.Username
 			session.Values["projects"] = user.Projects
 			session.Values["roles"] = user.Roles
+			session.Values["authSource"] = strconv.Itoa(int(user.AuthSource))
 			if err := auth.sessionStore.Save(r, rw, session); err != nil {
 				log.Warnf("session save failed: %s", err.Error())
 				http.Error(rw, err.Error(), http.StatusInternalServerError)
@@ -258,6 +372,10 @@ func (auth *Authentication) Auth(
 	onsuccess http.Handler,
 	onfailure func(rw http.ResponseWriter, r *http.Request, authErr error)) http.Handler {
 
+	if auth.ChangePasswordURL != "" {
+		onsuccess = auth.EnforcePasswordRotation(auth.ChangePasswordURL)(onsuccess)
+	}
+
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 
 		user, err := auth.JwtAuth.AuthViaJWT(rw, r)
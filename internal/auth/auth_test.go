@@ -0,0 +1,62 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// TestAuthViaSessionRolesNotProjects guards against AuthViaSession
+// reading session.Values["projects"] for both fields: Roles and
+// Projects must come from their own session keys, even when a project
+// happens to share a name with a gated role (e.g. a project literally
+// named "admin").
+func TestAuthViaSessionRolesNotProjects(t *testing.T) {
+	auth := &Authentication{
+		sessionStore: sessions.NewCookieStore([]byte("01234567890123456789012345678901")),
+	}
+
+	saveReq := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+
+	session, err := auth.sessionStore.New(saveReq, "session")
+	if err != nil {
+		t.Fatalf("sessionStore.New: %s", err.Error())
+	}
+	session.Values["username"] = "alice"
+	session.Values["projects"] = []string{"admin"}
+	session.Values["roles"] = []string{"user"}
+	session.Values["authSource"] = strconv.Itoa(int(AuthViaLocalPassword))
+	if err := auth.sessionStore.Save(saveReq, rec, session); err != nil {
+		t.Fatalf("sessionStore.Save: %s", err.Error())
+	}
+
+	readReq := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		readReq.AddCookie(c)
+	}
+
+	user, err := auth.AuthViaSession(httptest.NewRecorder(), readReq)
+	if err != nil {
+		t.Fatalf("AuthViaSession: %s", err.Error())
+	}
+	if user == nil {
+		t.Fatal("AuthViaSession returned a nil user for a saved session")
+	}
+
+	if len(user.Roles) != 1 || user.Roles[0] != "user" {
+		t.Fatalf("Roles = %v, want [user]", user.Roles)
+	}
+	if len(user.Projects) != 1 || user.Projects[0] != "admin" {
+		t.Fatalf("Projects = %v, want [admin]", user.Projects)
+	}
+	if user.HasRole("admin") {
+		t.Fatal("user must not be granted role 'admin' just because a project is named 'admin'")
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ClusterCockpit/cc-backend/pkg/log"
+)
+
+// ParseScopesClaim extracts a scope/scp claim from decoded JWT claims,
+// accepting either the RFC 8693 space-separated string form or a JSON
+// array. JWTAuthenticator calls this with its configured scope claim
+// name (default "scope") when populating User.Scopes, so that
+// token-issued sessions can be restricted via RequireScope.
+func ParseScopesClaim(claims map[string]interface{}, claimName string) []string {
+	if claimName == "" {
+		claimName = "scope"
+	}
+
+	v, ok := claims[claimName]
+	if !ok {
+		return nil
+	}
+
+	switch val := v.(type) {
+	case string:
+		return strings.Fields(val)
+	case []interface{}:
+		out := make([]string, 0, len(val))
+		for _, e := range val {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+// authzError is the structured body written by RequireRole/RequireProject/
+// RequireScope (and the policy middleware) on a 403.
+type authzError struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+func forbidden(rw http.ResponseWriter, reason string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(rw).Encode(authzError{Error: "forbidden", Reason: reason})
+}
+
+// RequireRole returns middleware that only lets a request through if
+// GetUser(ctx) is set and has at least one of the given roles.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			user := GetUser(r.Context())
+			if user == nil {
+				forbidden(rw, "not authenticated")
+				return
+			}
+
+			for _, role := range roles {
+				if user.HasRole(role) {
+					next.ServeHTTP(rw, r)
+					return
+				}
+			}
+
+			forbidden(rw, fmt.Sprintf("requires one of roles: %v", roles))
+		})
+	}
+}
+
+// RequireProject returns middleware that only lets a request through if
+// GetUser(ctx) has the project named by the projectParam URL query
+// parameter among its Projects. Users with the "admin" role bypass the
+// check, mirroring how project-scoped data access already works
+// elsewhere in the UI/API.
+func RequireProject(projectParam string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			user := GetUser(r.Context())
+			if user == nil {
+				forbidden(rw, "not authenticated")
+				return
+			}
+
+			if user.HasRole("admin") {
+				next.ServeHTTP(rw, r)
+				return
+			}
+
+			project := r.URL.Query().Get(projectParam)
+			if project == "" || !user.HasProject(project) {
+				forbidden(rw, fmt.Sprintf("requires membership in project '%s'", project))
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// RequireScope returns middleware that only lets a request through if
+// GetUser(ctx) has every one of the given scopes. A user with no
+// Scopes at all is treated as unrestricted (see User.HasScope), so this
+// only bites for tokens that were explicitly issued with a narrower
+// scope claim.
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			user := GetUser(r.Context())
+			if user == nil {
+				forbidden(rw, "not authenticated")
+				return
+			}
+
+			for _, scope := range scopes {
+				if !user.HasScope(scope) {
+					forbidden(rw, fmt.Sprintf("requires scope '%s'", scope))
+					return
+				}
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// Policy maps a URL pattern to the roles and/or scopes required to
+// access it. Policies are evaluated in order; the first matching
+// pattern wins. Patterns follow path.Match's single-segment glob rules
+// (e.g. "/api/jobs/*/delete" matches exactly one segment in place of
+// "*"), except that a pattern ending in "/**" matches that prefix plus
+// any number of further segments, so a whole API subtree can be
+// covered with one entry - see matchPolicyPattern.
+type Policy struct {
+	Pattern string   `json:"pattern"`
+	Roles   []string `json:"roles"`
+	Scopes  []string `json:"scopes"`
+}
+
+// LoadPolicies reads the policy DSL out of the "policies" slot of the
+// configs map passed to Init, e.g.:
+//
+//	"policies": [
+//	  {"pattern": "/api/jobs/*/delete", "roles": ["admin"]},
+//	  {"pattern": "/api/**", "scopes": ["metrics"]}
+//	]
+func LoadPolicies(conf interface{}) ([]Policy, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	raw, err := json.Marshal(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var policies []Policy
+	if err := json.Unmarshal(raw, &policies); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// matchPolicyPattern reports whether path matches pattern. path.Match's
+// "*" only ever matches within a single path segment, so a pattern
+// like "/api/*" does not cover "/api/jobs/123" - only "/api/jobs". A
+// pattern ending in "/**" instead matches its prefix and everything
+// beneath it, covering an entire subtree regardless of depth.
+func matchPolicyPattern(pattern, p string) (bool, error) {
+	if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return p == prefix || strings.HasPrefix(p, prefix+"/"), nil
+	}
+	return path.Match(pattern, p)
+}
+
+// PolicyMiddleware applies the first Policy whose Pattern matches the
+// request path, enforcing its Roles/Scopes the same way RequireRole/
+// RequireScope would. Requests matching no policy pass through
+// unchanged, so this composes with handler-level RequireRole/
+// RequireProject/RequireScope rather than replacing them; it exists so
+// new routes inherit sane defaults even before a developer adds an
+// explicit check.
+func PolicyMiddleware(policies []Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			for _, policy := range policies {
+				matched, err := matchPolicyPattern(policy.Pattern, r.URL.Path)
+				if err != nil {
+					log.Warnf("auth: invalid policy pattern '%s': %s", policy.Pattern, err.Error())
+					continue
+				}
+				if !matched {
+					continue
+				}
+
+				user := GetUser(r.Context())
+				if user == nil {
+					forbidden(rw, "not authenticated")
+					return
+				}
+
+				if len(policy.Roles) > 0 {
+					allowed := false
+					for _, role := range policy.Roles {
+						if user.HasRole(role) {
+							allowed = true
+							break
+						}
+					}
+					if !allowed {
+						forbidden(rw, fmt.Sprintf("requires one of roles: %v", policy.Roles))
+						return
+					}
+				}
+
+				for _, scope := range policy.Scopes {
+					if !user.HasScope(scope) {
+						forbidden(rw, fmt.Sprintf("requires scope '%s'", scope))
+						return
+					}
+				}
+
+				break
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
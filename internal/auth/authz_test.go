@@ -0,0 +1,35 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import "testing"
+
+func TestMatchPolicyPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{"/api/jobs/*/delete", "/api/jobs/123/delete", true},
+		{"/api/jobs/*/delete", "/api/jobs/123/456/delete", false},
+		{"/api/*", "/api/jobs", true},
+		{"/api/*", "/api/jobs/123", false},
+		{"/api/**", "/api", true},
+		{"/api/**", "/api/jobs", true},
+		{"/api/**", "/api/jobs/123", true},
+		{"/api/**", "/apixyz", false},
+		{"/api/**", "/other", false},
+	}
+
+	for _, c := range cases {
+		got, err := matchPolicyPattern(c.pattern, c.path)
+		if err != nil {
+			t.Fatalf("matchPolicyPattern(%q, %q) returned error: %s", c.pattern, c.path, err.Error())
+		}
+		if got != c.want {
+			t.Errorf("matchPolicyPattern(%q, %q) = %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ClusterCockpit/cc-backend/pkg/log"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWTAuthenticator verifies bearer tokens signed with the ed25519
+// keypair generated by tools/gen-keypair (JWT_PUBLIC_KEY/JWT_PRIVATE_KEY).
+// It populates User.Scopes from a configurable claim so that
+// RequireScope can restrict what a given token is allowed to do.
+type JWTAuthenticator struct {
+	auth       *Authentication
+	publicKey  ed25519.PublicKey
+	scopeClaim string
+}
+
+func (ja *JWTAuthenticator) Init(auth *Authentication, conf interface{}) error {
+	ja.auth = auth
+	ja.scopeClaim = "scope"
+
+	if config, ok := conf.(map[string]interface{}); ok {
+		if claim, ok := config["scope_claim"].(string); ok && claim != "" {
+			ja.scopeClaim = claim
+		}
+	}
+
+	pubKeyStr := os.Getenv("JWT_PUBLIC_KEY")
+	if pubKeyStr == "" {
+		log.Warn("environment variable 'JWT_PUBLIC_KEY' not set (JWT authentication disabled)")
+		return nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(pubKeyStr)
+	if err != nil {
+		log.Error("Error while initializing authentication -> decoding JWT_PUBLIC_KEY failed")
+		return err
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return errors.New("auth jwt: JWT_PUBLIC_KEY has the wrong size for an ed25519 public key")
+	}
+
+	ja.publicKey = ed25519.PublicKey(raw)
+	return nil
+}
+
+// AuthViaJWT validates the bearer token on the request (if any) and
+// builds a *User from its claims; a nil user with a nil error means
+// "no usable token" (none presented, or one that fails verification or
+// carries no "sub" claim), which Authentication.Auth treats as
+// "try AuthViaSession next".
+func (ja *JWTAuthenticator) AuthViaJWT(rw http.ResponseWriter, r *http.Request) (*User, error) {
+	if ja.publicKey == nil {
+		return nil, nil
+	}
+
+	header := r.Header.Get("Authorization")
+	rawToken, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || rawToken == "" {
+		return nil, nil
+	}
+
+	token, err := jwt.Parse(rawToken, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodEd25519); !ok {
+			return nil, errors.New("auth jwt: unexpected signing method")
+		}
+		return ja.publicKey, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, nil
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, nil
+	}
+
+	username, _ := claims["sub"].(string)
+	if username == "" {
+		return nil, nil
+	}
+
+	return &User{
+		Username:   username,
+		Roles:      stringSliceClaim(claims, "roles"),
+		Projects:   stringSliceClaim(claims, "projects"),
+		Scopes:     ParseScopesClaim(claims, ja.scopeClaim),
+		AuthType:   AuthToken,
+		AuthSource: AuthViaToken,
+	}, nil
+}
@@ -0,0 +1,192 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ClusterCockpit/cc-backend/pkg/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LocalAuthenticator is the username/password authenticator: it is the
+// thing that actually applies PasswordPolicy and the login_attempts/
+// password_rotation bookkeeping defined in password_policy.go. It is
+// always registered (see Init), and CanLogin simply restricts it to
+// users provisioned with AuthViaLocalPassword who have a password hash
+// set, so it never interferes with LDAP, WebAuthn, OIDC or token users
+// sharing the same generic Authentication.Login loop.
+type LocalAuthenticator struct {
+	auth   *Authentication
+	policy PasswordPolicy
+}
+
+func (la *LocalAuthenticator) Init(auth *Authentication, conf interface{}) error {
+	la.auth = auth
+	la.policy = DefaultPasswordPolicy
+
+	if config, ok := conf.(map[string]interface{}); ok {
+		if policyConf, ok := config["password_policy"].(map[string]interface{}); ok {
+			applyPasswordPolicyConfig(&la.policy, policyConf)
+		}
+	}
+
+	if err := ensureLoginAttemptsTable(auth); err != nil {
+		log.Error("Error while initializing authentication -> creating login_attempts table failed")
+		return err
+	}
+	if err := ensurePasswordRotationTable(auth); err != nil {
+		log.Error("Error while initializing authentication -> creating password_rotation table failed")
+		return err
+	}
+	if err := ensurePasswordHistoryTable(auth); err != nil {
+		log.Error("Error while initializing authentication -> creating password_history table failed")
+		return err
+	}
+
+	return nil
+}
+
+// applyPasswordPolicyConfig overrides the fields of policy that are
+// present in config, leaving the rest at their DefaultPasswordPolicy
+// values.
+func applyPasswordPolicyConfig(policy *PasswordPolicy, config map[string]interface{}) {
+	if v, ok := config["min_length"].(float64); ok {
+		policy.MinLength = int(v)
+	}
+	if v, ok := config["require_upper"].(bool); ok {
+		policy.RequireUpper = v
+	}
+	if v, ok := config["require_lower"].(bool); ok {
+		policy.RequireLower = v
+	}
+	if v, ok := config["require_digit"].(bool); ok {
+		policy.RequireDigit = v
+	}
+	if v, ok := config["require_special"].(bool); ok {
+		policy.RequireSpecial = v
+	}
+	if v, ok := config["min_zxcvbn_score"].(float64); ok {
+		policy.MinZxcvbnScore = int(v)
+	}
+	if v, ok := config["history_depth"].(float64); ok {
+		policy.HistoryDepth = int(v)
+	}
+	if v, ok := config["bcrypt_cost"].(float64); ok {
+		policy.BcryptCost = int(v)
+	}
+	if v, ok := config["max_age_days"].(float64); ok {
+		policy.MaxAge = time.Duration(v) * 24 * time.Hour
+	}
+}
+
+// CanLogin restricts LocalAuthenticator to users that were provisioned
+// with a local password; LDAP/WebAuthn/OIDC users never have
+// AuthSource == AuthViaLocalPassword, so they fall through to their own
+// authenticator (or, for WebAuthn/OIDC, bypass this loop entirely).
+func (la *LocalAuthenticator) CanLogin(user *User, rw http.ResponseWriter, r *http.Request) bool {
+	return user != nil && user.AuthSource == AuthViaLocalPassword && user.Password != ""
+}
+
+// Login enforces CheckLoginAllowed's backoff/lockout before even looking
+// at the submitted password, records/clears failures in login_attempts,
+// and lazily rehashes the stored hash if the policy's bcrypt cost has
+// since been raised.
+func (la *LocalAuthenticator) Login(user *User, rw http.ResponseWriter, r *http.Request) (*User, error) {
+	ip := remoteIP(r)
+
+	retryAfter, locked, err := la.auth.CheckLoginAllowed(user.Username, ip)
+	if err != nil {
+		return nil, err
+	}
+	if locked || retryAfter > 0 {
+		RespondLockedOut(rw, retryAfter)
+		return nil, errors.New("auth local: too many failed login attempts")
+	}
+
+	password := r.FormValue("password")
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		if ferr := la.auth.RecordLoginFailure(user.Username, ip); ferr != nil {
+			log.Errorf("auth local: could not record login failure for '%s': %s", user.Username, ferr.Error())
+		}
+		return nil, errors.New("auth local: invalid username or password")
+	}
+
+	if err := la.auth.ClearLoginAttempts(user.Username, ip); err != nil {
+		log.Errorf("auth local: could not clear login attempts for '%s': %s", user.Username, err.Error())
+	}
+
+	if newHash, rehashed, err := la.policy.RehashIfNeeded(user.Password, password); err != nil {
+		log.Errorf("auth local: could not check bcrypt cost for '%s': %s", user.Username, err.Error())
+	} else if rehashed {
+		user.Password = newHash
+		if err := la.auth.UpdateUser(user); err != nil {
+			log.Errorf("auth local: could not persist rehashed password for '%s': %s", user.Username, err.Error())
+		}
+	}
+
+	return user, nil
+}
+
+// SetPassword validates a new password against the policy, hashes it,
+// persists it via UpdateUser and clears any pending forced rotation.
+// Callers (e.g. a "change password" handler, possibly wrapped by
+// Authentication.EnforcePasswordRotation) are expected to have already
+// authenticated the user some other way before calling this.
+func (la *LocalAuthenticator) SetPassword(username, password string) error {
+	user, err := la.auth.GetUser(username)
+	if err != nil {
+		return err
+	}
+
+	if err := la.policy.Validate(password, user.Username, user.Name, user.Email); err != nil {
+		return err
+	}
+
+	if err := la.policy.CheckPasswordHistory(la.auth, username, password); err != nil {
+		return err
+	}
+
+	hash, err := la.policy.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
+	user.AuthSource = AuthViaLocalPassword
+	if err := la.auth.UpdateUser(user); err != nil {
+		return err
+	}
+
+	if err := la.policy.RecordPasswordHistory(la.auth, username, hash); err != nil {
+		return err
+	}
+
+	return la.auth.ClearPasswordRotation(username)
+}
+
+// AddUser validates and hashes password according to the policy and
+// provisions a new local-password user. Unlike SetPassword, there is no
+// existing row to update, so this calls auth.AddUser directly.
+func (la *LocalAuthenticator) AddUser(user *User, password string) error {
+	if err := la.policy.Validate(password, user.Username, user.Name, user.Email); err != nil {
+		return err
+	}
+
+	hash, err := la.policy.HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	user.Password = hash
+	user.AuthSource = AuthViaLocalPassword
+	if err := la.auth.AddUser(user); err != nil {
+		return err
+	}
+
+	return la.policy.RecordPasswordHistory(la.auth, user.Username, hash)
+}
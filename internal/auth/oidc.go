@@ -0,0 +1,460 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ClusterCockpit/cc-backend/pkg/log"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// oidcProvider bundles everything needed to federate to a single
+// configured IdP: the oauth2 client, the OIDC verifier (which keeps its
+// JWKS fresh in the background) and the claim names used to populate a
+// User from the ID token.
+type oidcProvider struct {
+	name          string
+	oauth2Config  oauth2.Config
+	verifier      *oidc.IDTokenVerifier
+	nameClaim     string
+	emailClaim    string
+	rolesClaim    string
+	projectsClaim string
+}
+
+// OIDCAuthenticator performs Authorization Code + PKCE against one or
+// more configured OIDC issuers (e.g. Keycloak, Dex, Hydra), keyed by
+// provider name so an operator can offer several IdPs (an institutional
+// SSO plus a fallback) side by side.
+type OIDCAuthenticator struct {
+	auth      *Authentication
+	providers map[string]*oidcProvider
+}
+
+func (oa *OIDCAuthenticator) Init(auth *Authentication, conf interface{}) error {
+	oa.auth = auth
+	oa.providers = map[string]*oidcProvider{}
+
+	configs, ok := conf.(map[string]interface{})
+	if !ok {
+		return errors.New("auth oidc: invalid configuration")
+	}
+
+	for name, raw := range configs {
+		pconf, ok := raw.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("auth oidc: invalid configuration for provider '%s'", name)
+		}
+
+		issuer, _ := pconf["issuer"].(string)
+		clientId, _ := pconf["client_id"].(string)
+		clientSecret, _ := pconf["client_secret"].(string)
+		redirectUrl, _ := pconf["redirect_url"].(string)
+		if issuer == "" || clientId == "" || redirectUrl == "" {
+			return fmt.Errorf("auth oidc: provider '%s' requires 'issuer', 'client_id' and 'redirect_url'", name)
+		}
+
+		scopes := []string{oidc.ScopeOpenID, "profile", "email"}
+		if raw, ok := pconf["scopes"].([]interface{}); ok {
+			scopes = scopes[:1]
+			for _, s := range raw {
+				if str, ok := s.(string); ok {
+					scopes = append(scopes, str)
+				}
+			}
+		}
+
+		provider, err := oidc.NewProvider(context.Background(), issuer)
+		if err != nil {
+			log.Errorf("auth oidc: could not discover issuer '%s' for provider '%s': %s", issuer, name, err.Error())
+			return err
+		}
+
+		rolesClaim, _ := pconf["roles_claim"].(string)
+		projectsClaim, _ := pconf["projects_claim"].(string)
+
+		oa.providers[name] = &oidcProvider{
+			name: name,
+			oauth2Config: oauth2.Config{
+				ClientID:     clientId,
+				ClientSecret: clientSecret,
+				RedirectURL:  redirectUrl,
+				Endpoint:     provider.Endpoint(),
+				Scopes:       scopes,
+			},
+			verifier:      provider.Verifier(&oidc.Config{ClientID: clientId}),
+			nameClaim:     stringOr(pconf["name_claim"], "name"),
+			emailClaim:    stringOr(pconf["email_claim"], "email"),
+			rolesClaim:    stringOr(rolesClaim, "roles"),
+			projectsClaim: stringOr(projectsClaim, "groups"),
+		}
+	}
+
+	if _, err := auth.db.Exec(`
+		CREATE TABLE IF NOT EXISTS oidc_identities (
+			provider varchar(255) NOT NULL,
+			subject  varchar(255) NOT NULL,
+			username varchar(255) NOT NULL,
+			PRIMARY KEY (provider, subject)
+		)`); err != nil {
+		log.Error("Error while initializing authentication -> creating oidc_identities table failed")
+		return err
+	}
+
+	// A separate CREATE UNIQUE INDEX (rather than an inline UNIQUE column
+	// constraint) so that deployments upgrading from a pre-existing
+	// oidc_identities table - where CREATE TABLE IF NOT EXISTS above is a
+	// no-op - also get the constraint that closes the identity-binding
+	// race, instead of silently keeping the old, unconstrained schema.
+	if _, err := auth.db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS oidc_identities_username_unique ON oidc_identities (username)`); err != nil {
+		log.Error("Error while initializing authentication -> creating oidc_identities_username_unique index failed")
+		return err
+	}
+
+	return nil
+}
+
+// lookupIdentity returns the username bound to a (provider, subject)
+// pair, if any. This - not the token's preferred_username claim - is
+// the authoritative source of identity for a returning user, so that a
+// second IdP (or a compromised/misconfigured one) cannot take over an
+// existing account just by asserting a matching preferred_username.
+func (oa *OIDCAuthenticator) lookupIdentity(provider, subject string) (string, error) {
+	var username string
+	err := oa.auth.db.Get(&username,
+		`SELECT username FROM oidc_identities WHERE provider = ? AND subject = ?`, provider, subject)
+	return username, err
+}
+
+func (oa *OIDCAuthenticator) linkIdentity(provider, subject, username string) error {
+	_, err := oa.auth.db.Exec(
+		`INSERT INTO oidc_identities (provider, subject, username) VALUES (?, ?, ?)`,
+		provider, subject, username)
+	return err
+}
+
+// hasIdentity reports whether username already has at least one
+// (provider, subject) bound to it. Used to refuse implicitly binding a
+// second identity to an account by username match alone - that would
+// let a different provider (or a different subject at the same
+// provider) take over an account that some other IdP already owns.
+func (oa *OIDCAuthenticator) hasIdentity(username string) (bool, error) {
+	var count int
+	if err := oa.auth.db.Get(&count, `SELECT COUNT(*) FROM oidc_identities WHERE username = ?`, username); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// refuseOIDCBind reports whether an implicit (candidate-username-match)
+// OIDC identity bind must be refused for an existing account: either it
+// isn't OIDC-managed yet (it belongs to local/LDAP/some other source),
+// or it already has some other (provider, subject) linked to it. Either
+// way, binding here would let a second (or malicious) IdP asserting a
+// matching preferred_username take over an account some other, already-
+// trusted source owns. Split out from CallbackHandler so the decision
+// can be unit-tested without a database.
+func refuseOIDCBind(existingAuthSource AuthSource, alreadyLinked bool) bool {
+	return existingAuthSource != AuthViaOIDC || alreadyLinked
+}
+
+func stringOr(v interface{}, def string) string {
+	if s, ok := v.(string); ok && s != "" {
+		return s
+	}
+	return def
+}
+
+// CanLogin is always false: OIDC is a redirect-based flow entered via
+// LoginHandler, never via the username/password form that drives the
+// generic Authentication.Login loop.
+func (oa *OIDCAuthenticator) CanLogin(user *User, rw http.ResponseWriter, r *http.Request) bool {
+	return false
+}
+
+// Login is unreachable in practice (see CanLogin); the real
+// authentication happens in CallbackHandler once the IdP redirects
+// back with an authorization code.
+func (oa *OIDCAuthenticator) Login(user *User, rw http.ResponseWriter, r *http.Request) (*User, error) {
+	return nil, errors.New("auth oidc: login must go through LoginHandler/CallbackHandler")
+}
+
+func randomString() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+// LoginHandler redirects the browser to the named provider's
+// authorization endpoint, stashing state, nonce and the PKCE code
+// verifier in the session so CallbackHandler can validate them.
+func (oa *OIDCAuthenticator) LoginHandler(providerName string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p, ok := oa.providers[providerName]
+		if !ok {
+			http.Error(rw, "unknown oidc provider", http.StatusNotFound)
+			return
+		}
+
+		state, err := randomString()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		nonce, err := randomString()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		verifier := oauth2.GenerateVerifier()
+
+		session, err := oa.auth.sessionStore.New(r, "session")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		session.Values["oidc_provider"] = providerName
+		session.Values["oidc_state"] = state
+		session.Values["oidc_nonce"] = nonce
+		session.Values["oidc_verifier"] = verifier
+		if err := oa.auth.sessionStore.Save(r, rw, session); err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		url := p.oauth2Config.AuthCodeURL(state,
+			oidc.Nonce(nonce),
+			oauth2.S256ChallengeOption(verifier))
+		http.Redirect(rw, r, url, http.StatusFound)
+	})
+}
+
+// CallbackHandler exchanges the authorization code, verifies the ID
+// token against the issuer's (periodically refreshed) JWKS, maps its
+// claims onto a User, auto-provisions unknown users, and then drives
+// the same session population as Authentication.Login so that
+// AuthViaSession sees the result on the next request.
+func (oa *OIDCAuthenticator) CallbackHandler(
+	providerName string,
+	onsuccess http.Handler,
+	onfailure func(rw http.ResponseWriter, r *http.Request, err error)) http.Handler {
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		p, ok := oa.providers[providerName]
+		if !ok {
+			onfailure(rw, r, errors.New("unknown oidc provider"))
+			return
+		}
+
+		session, err := oa.auth.sessionStore.Get(r, "session")
+		if err != nil {
+			onfailure(rw, r, err)
+			return
+		}
+
+		wantState, _ := session.Values["oidc_state"].(string)
+		nonce, _ := session.Values["oidc_nonce"].(string)
+		verifier, _ := session.Values["oidc_verifier"].(string)
+		delete(session.Values, "oidc_state")
+		delete(session.Values, "oidc_nonce")
+		delete(session.Values, "oidc_verifier")
+		_ = oa.auth.sessionStore.Save(r, rw, session)
+
+		if wantState == "" || r.URL.Query().Get("state") != wantState {
+			onfailure(rw, r, errors.New("auth oidc: state mismatch"))
+			return
+		}
+
+		token, err := p.oauth2Config.Exchange(r.Context(), r.URL.Query().Get("code"),
+			oauth2.VerifierOption(verifier))
+		if err != nil {
+			onfailure(rw, r, err)
+			return
+		}
+
+		rawIdToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			onfailure(rw, r, errors.New("auth oidc: no id_token in token response"))
+			return
+		}
+
+		idToken, err := p.verifier.Verify(r.Context(), rawIdToken)
+		if err != nil {
+			onfailure(rw, r, err)
+			return
+		}
+		if idToken.Nonce != nonce {
+			onfailure(rw, r, errors.New("auth oidc: nonce mismatch"))
+			return
+		}
+
+		var claims map[string]interface{}
+		if err := idToken.Claims(&claims); err != nil {
+			onfailure(rw, r, err)
+			return
+		}
+
+		// The username is never taken from the token's claims directly:
+		// a (provider, subject) pair is bound to a username once, on
+		// first login, and every subsequent login for that same pair
+		// must resolve to that same username - regardless of what
+		// preferred_username the IdP asserts this time around. Without
+		// this, a second (or compromised/misconfigured) IdP asserting a
+		// matching preferred_username could silently take over an
+		// existing local/LDAP/other-provider account and inherit its
+		// roles and projects.
+		username, identityErr := oa.lookupIdentity(providerName, idToken.Subject)
+		if identityErr != nil && !errors.Is(identityErr, sql.ErrNoRows) {
+			// A transient lookup failure must not be treated the same
+			// as "no binding exists yet" - that would fall through to
+			// the bind-by-username path below and could re-link (or
+			// error re-inserting) an already-bound identity.
+			onfailure(rw, r, identityErr)
+			return
+		}
+		if errors.Is(identityErr, sql.ErrNoRows) {
+			candidate, _ := claims["preferred_username"].(string)
+			if candidate == "" {
+				candidate = idToken.Subject
+			}
+
+			existing, lookupErr := oa.auth.GetUser(candidate)
+			if lookupErr != nil && !errors.Is(lookupErr, sql.ErrNoRows) {
+				onfailure(rw, r, lookupErr)
+				return
+			}
+			existingFound := lookupErr == nil && existing != nil
+
+			if existingFound {
+				alreadyLinked, err := oa.hasIdentity(candidate)
+				if err != nil {
+					onfailure(rw, r, err)
+					return
+				}
+				if refuseOIDCBind(existing.AuthSource, alreadyLinked) {
+					log.Warnf("auth oidc: refusing to bind provider '%s' subject '%s' to existing account '%s' (authSource %v, already linked: %v)",
+						providerName, idToken.Subject, candidate, existing.AuthSource, alreadyLinked)
+					onfailure(rw, r, fmt.Errorf("auth oidc: account '%s' is not managed by provider '%s'", candidate, providerName))
+					return
+				}
+			} else {
+				if err := oa.auth.AddUser(&User{
+					Username:   candidate,
+					Name:       stringClaim(claims, p.nameClaim),
+					Email:      stringClaim(claims, p.emailClaim),
+					Roles:      stringSliceClaim(claims, p.rolesClaim),
+					Projects:   stringSliceClaim(claims, p.projectsClaim),
+					AuthType:   AuthSession,
+					AuthSource: AuthViaOIDC,
+				}); err != nil {
+					log.Errorf("auth oidc: could not provision new user '%s': %s", candidate, err.Error())
+					onfailure(rw, r, err)
+					return
+				}
+			}
+
+			if err := oa.linkIdentity(providerName, idToken.Subject, candidate); err != nil {
+				log.Errorf("auth oidc: could not bind provider '%s' subject '%s' to user '%s': %s",
+					providerName, idToken.Subject, candidate, err.Error())
+				onfailure(rw, r, err)
+				return
+			}
+			username = candidate
+		}
+
+		dbUser, err := oa.auth.GetUser(username)
+		if err != nil {
+			onfailure(rw, r, err)
+			return
+		}
+
+		user := &User{
+			Username:   username,
+			Name:       dbUser.Name,
+			Email:      stringClaim(claims, p.emailClaim),
+			Roles:      stringSliceClaim(claims, p.rolesClaim),
+			Projects:   stringSliceClaim(claims, p.projectsClaim),
+			AuthType:   AuthSession,
+			AuthSource: AuthViaOIDC,
+		}
+
+		newSession, err := oa.auth.sessionStore.New(r, "session")
+		if err != nil {
+			onfailure(rw, r, err)
+			return
+		}
+		if oa.auth.SessionMaxAge != 0 {
+			newSession.Options.MaxAge = int(oa.auth.SessionMaxAge.Seconds())
+		}
+		newSession.Values["username"] = user.Username
+		newSession.Values["projects"] = user.Projects
+		newSession.Values["roles"] = user.Roles
+		newSession.Values["authSource"] = strconv.Itoa(int(user.AuthSource))
+		if err := oa.auth.sessionStore.Save(r, rw, newSession); err != nil {
+			onfailure(rw, r, err)
+			return
+		}
+
+		log.Infof("login successfull: user: %#v (roles: %v, projects: %v) via oidc provider '%s'",
+			user.Username, user.Roles, user.Projects, providerName)
+		ctx := context.WithValue(r.Context(), ContextUserKey, user)
+		onsuccess.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// stringClaim resolves a dot-separated claim path such as
+// "realm_access.roles" against a decoded claims map.
+func stringClaim(claims map[string]interface{}, path string) string {
+	v := claimAt(claims, path)
+	s, _ := v.(string)
+	return s
+}
+
+func stringSliceClaim(claims map[string]interface{}, path string) []string {
+	v := claimAt(claims, path)
+	switch vals := v.(type) {
+	case []string:
+		return vals
+	case []interface{}:
+		out := make([]string, 0, len(vals))
+		for _, e := range vals {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		return nil
+	}
+}
+
+func claimAt(claims map[string]interface{}, path string) interface{} {
+	parts := strings.Split(path, ".")
+	var cur interface{} = claims
+	for _, part := range parts {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur, ok = m[part]
+		if !ok {
+			return nil
+		}
+	}
+	return cur
+}
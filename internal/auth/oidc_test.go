@@ -0,0 +1,29 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import "testing"
+
+func TestRefuseOIDCBind(t *testing.T) {
+	cases := []struct {
+		name               string
+		existingAuthSource AuthSource
+		alreadyLinked      bool
+		want               bool
+	}{
+		{"non-oidc account, no existing link", AuthViaLocalPassword, false, true},
+		{"non-oidc account, somehow already linked", AuthViaLDAP, true, true},
+		{"oidc account, already linked to another identity", AuthViaOIDC, true, true},
+		{"oidc account, no existing link yet (pre-identity-tracking upgrade)", AuthViaOIDC, false, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := refuseOIDCBind(c.existingAuthSource, c.alreadyLinked); got != c.want {
+				t.Errorf("refuseOIDCBind(%v, %v) = %v, want %v", c.existingAuthSource, c.alreadyLinked, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,416 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ClusterCockpit/cc-backend/pkg/log"
+	zxcvbn "github.com/nbutton23/zxcvbn-go"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordPolicy describes the constraints LocalAuthenticator enforces
+// whenever a password is set, via SetPassword or as part of AddUser.
+type PasswordPolicy struct {
+	MinLength      int
+	RequireUpper   bool
+	RequireLower   bool
+	RequireDigit   bool
+	RequireSpecial bool
+	MinZxcvbnScore int           // 0-4, see github.com/nbutton23/zxcvbn-go
+	MaxAge         time.Duration // 0 means passwords never expire
+	HistoryDepth   int           // how many previous hashes SetPassword refuses to reuse
+	BcryptCost     int
+}
+
+// DefaultPasswordPolicy is used by LocalAuthenticator.Init when no
+// "password_policy" config section is given.
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:      12,
+	RequireUpper:   true,
+	RequireLower:   true,
+	RequireDigit:   true,
+	RequireSpecial: true,
+	MinZxcvbnScore: 3,
+	MaxAge:         0,
+	HistoryDepth:   5,
+	BcryptCost:     bcrypt.DefaultCost,
+}
+
+// Validate checks a candidate password against the policy's character
+// class and length requirements and its minimum zxcvbn strength score.
+// userInputs (username, name, email, ...) are fed to zxcvbn so that
+// passwords built out of the user's own identity score low even if
+// they'd otherwise pass the character-class checks.
+func (p PasswordPolicy) Validate(password string, userInputs ...string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSpecial bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSpecial = true
+		}
+	}
+
+	if p.RequireUpper && !hasUpper {
+		return errors.New("password must contain an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		return errors.New("password must contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		return errors.New("password must contain a digit")
+	}
+	if p.RequireSpecial && !hasSpecial {
+		return errors.New("password must contain a special character")
+	}
+
+	if p.MinZxcvbnScore > 0 {
+		result := zxcvbn.PasswordStrength(password, userInputs)
+		if result.Score < p.MinZxcvbnScore {
+			return fmt.Errorf("password is too weak (score %d/%d)", result.Score, p.MinZxcvbnScore)
+		}
+	}
+
+	return nil
+}
+
+// HashPassword hashes a (already-validated) password at the policy's
+// configured bcrypt cost.
+func (p PasswordPolicy) HashPassword(password string) (string, error) {
+	cost := p.BcryptCost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// RehashIfNeeded re-hashes a password at the policy's current target
+// cost if the stored hash was produced with a lower cost, the same way
+// many auth systems lazily upgrade old hashes as users log in. It
+// should be called by LocalAuthenticator.Login right after a
+// bcrypt.CompareHashAndPassword succeeds, while the plaintext is still
+// available.
+func (p PasswordPolicy) RehashIfNeeded(storedHash, password string) (newHash string, rehashed bool, err error) {
+	cost := p.BcryptCost
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+
+	currentCost, err := bcrypt.Cost([]byte(storedHash))
+	if err != nil {
+		return "", false, err
+	}
+	if currentCost >= cost {
+		return storedHash, false, nil
+	}
+
+	newHash, err = p.HashPassword(password)
+	if err != nil {
+		return "", false, err
+	}
+	return newHash, true, nil
+}
+
+// ensurePasswordHistoryTable creates the password_history table, which
+// backs both CheckPasswordHistory/RecordPasswordHistory (the
+// HistoryDepth check) and PasswordAge/MustChangePassword (the MaxAge
+// check) - a password's age is just the set_at of its most recent row.
+func ensurePasswordHistoryTable(auth *Authentication) error {
+	if _, err := auth.db.Exec(`
+		CREATE TABLE IF NOT EXISTS password_history (
+			username varchar(255) NOT NULL,
+			hash     varchar(255) NOT NULL,
+			set_at   bigint NOT NULL
+		)`); err != nil {
+		return err
+	}
+	_, err := auth.db.Exec(`CREATE INDEX IF NOT EXISTS password_history_username ON password_history (username, set_at)`)
+	return err
+}
+
+// CheckPasswordHistory returns an error if password matches any of
+// username's last HistoryDepth passwords. Called by
+// LocalAuthenticator.SetPassword before a new password is hashed and
+// stored; a HistoryDepth of zero disables the check.
+func (p PasswordPolicy) CheckPasswordHistory(auth *Authentication, username, password string) error {
+	if p.HistoryDepth <= 0 {
+		return nil
+	}
+
+	var hashes []string
+	if err := auth.db.Select(&hashes,
+		`SELECT hash FROM password_history WHERE username = ? ORDER BY set_at DESC LIMIT ?`,
+		username, p.HistoryDepth); err != nil {
+		return err
+	}
+
+	for _, hash := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return fmt.Errorf("password must not match any of your last %d passwords", p.HistoryDepth)
+		}
+	}
+	return nil
+}
+
+// RecordPasswordHistory appends hash as username's current password and
+// prunes rows older than the policy's HistoryDepth so the table doesn't
+// grow without bound. Called by LocalAuthenticator.SetPassword/AddUser
+// right after a new hash is persisted.
+func (p PasswordPolicy) RecordPasswordHistory(auth *Authentication, username, hash string) error {
+	if _, err := auth.db.Exec(`INSERT INTO password_history (username, hash, set_at) VALUES (?, ?, ?)`,
+		username, hash, time.Now().Unix()); err != nil {
+		return err
+	}
+
+	if p.HistoryDepth <= 0 {
+		return nil
+	}
+
+	var cutoff int64
+	if err := auth.db.Get(&cutoff,
+		`SELECT set_at FROM password_history WHERE username = ? ORDER BY set_at DESC LIMIT 1 OFFSET ?`,
+		username, p.HistoryDepth-1); err != nil {
+		return nil // fewer than HistoryDepth rows on record yet; nothing to prune
+	}
+
+	_, err := auth.db.Exec(`DELETE FROM password_history WHERE username = ? AND set_at < ?`, username, cutoff)
+	return err
+}
+
+// PasswordAge returns how long it has been since username's password
+// was last set via SetPassword or AddUser. It returns an error if no
+// password_history row exists yet, e.g. for a non-local account.
+func (auth *Authentication) PasswordAge(username string) (time.Duration, error) {
+	var setAt int64
+	if err := auth.db.Get(&setAt,
+		`SELECT set_at FROM password_history WHERE username = ? ORDER BY set_at DESC LIMIT 1`, username); err != nil {
+		return 0, err
+	}
+	return time.Since(time.Unix(setAt, 0)), nil
+}
+
+// loginAttempt tracks failed local-password logins for a
+// (username, remote IP) pair, used to implement exponential backoff and
+// a hard lockout independent of any account-level state.
+type loginAttempt struct {
+	Username   string `db:"username"`
+	RemoteIP   string `db:"remote_ip"`
+	Count      int    `db:"count"`
+	LastFailAt int64  `db:"last_fail_at"` // Unix seconds
+}
+
+const (
+	// loginAttemptBaseBackoff is loginBackoff(0); CheckLoginAllowed
+	// imposes loginBackoff(count), so the first failure costs twice this
+	// and each further failure doubles it, up to loginAttemptLockout
+	// failures, at which point that (username, remote IP) pair is locked
+	// out entirely.
+	loginAttemptBaseBackoff = 1 * time.Second
+	loginAttemptLockout     = 10
+)
+
+// ensureLoginAttemptsTable creates the login_attempts table. Called by
+// LocalAuthenticator.Init alongside the policy setup.
+func ensureLoginAttemptsTable(auth *Authentication) error {
+	_, err := auth.db.Exec(`
+		CREATE TABLE IF NOT EXISTS login_attempts (
+			username     varchar(255) NOT NULL,
+			remote_ip    varchar(255) NOT NULL,
+			count        int NOT NULL DEFAULT 0,
+			last_fail_at bigint NOT NULL DEFAULT 0,
+			PRIMARY KEY (username, remote_ip)
+		)`)
+	return err
+}
+
+// loginBackoff returns the delay CheckLoginAllowed imposes after count
+// prior failures: it doubles with every failure, starting at
+// loginAttemptBaseBackoff. Split out from CheckLoginAllowed so the pure
+// math can be unit-tested without a database.
+func loginBackoff(count int) time.Duration {
+	return loginAttemptBaseBackoff << count
+}
+
+// CheckLoginAllowed must be called by LocalAuthenticator.Login before
+// even looking at the submitted password. It returns the remaining
+// backoff (zero if the attempt may proceed immediately) for the given
+// (username, remote IP) pair.
+func (auth *Authentication) CheckLoginAllowed(username, remoteIP string) (retryAfter time.Duration, locked bool, err error) {
+	var attempt loginAttempt
+	err = auth.db.Get(&attempt,
+		`SELECT username, remote_ip, count, last_fail_at FROM login_attempts WHERE username = ? AND remote_ip = ?`,
+		username, remoteIP)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil // no prior failures on record
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if attempt.Count >= loginAttemptLockout {
+		return 0, true, nil
+	}
+
+	backoff := loginBackoff(attempt.Count)
+	elapsed := time.Since(time.Unix(attempt.LastFailAt, 0))
+	if elapsed >= backoff {
+		return 0, false, nil
+	}
+	return backoff - elapsed, false, nil
+}
+
+// RecordLoginFailure increments the failure counter for a
+// (username, remote IP) pair, to be called by LocalAuthenticator.Login
+// whenever bcrypt.CompareHashAndPassword rejects the submitted password.
+func (auth *Authentication) RecordLoginFailure(username, remoteIP string) error {
+	_, err := auth.db.Exec(`
+		INSERT INTO login_attempts (username, remote_ip, count, last_fail_at)
+		VALUES (?, ?, 1, ?)
+		ON CONFLICT (username, remote_ip) DO UPDATE SET
+			count = count + 1,
+			last_fail_at = excluded.last_fail_at`,
+		username, remoteIP, time.Now().Unix())
+	return err
+}
+
+// ClearLoginAttempts resets the failure counter after a successful
+// login, as LocalAuthenticator.Login should do right after a
+// bcrypt.CompareHashAndPassword success.
+func (auth *Authentication) ClearLoginAttempts(username, remoteIP string) error {
+	_, err := auth.db.Exec(`DELETE FROM login_attempts WHERE username = ? AND remote_ip = ?`, username, remoteIP)
+	return err
+}
+
+// RespondLockedOut writes the 429 + Retry-After response
+// LocalAuthenticator.Login should return when CheckLoginAllowed reports
+// a nonzero backoff or a hard lockout.
+func RespondLockedOut(rw http.ResponseWriter, retryAfter time.Duration) {
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	rw.Header().Set("Retry-After", fmt.Sprintf("%d", int(retryAfter.Seconds())))
+	http.Error(rw, "too many failed login attempts", http.StatusTooManyRequests)
+}
+
+// ensurePasswordRotationTable creates the password_rotation table, which
+// persists the "must change password on next login" flag outside of the user table so it applies uniformly
+// regardless of which columns that table happens to have.
+func ensurePasswordRotationTable(auth *Authentication) error {
+	_, err := auth.db.Exec(`
+		CREATE TABLE IF NOT EXISTS password_rotation (
+			username varchar(255) PRIMARY KEY,
+			forced_at bigint NOT NULL
+		)`)
+	return err
+}
+
+// ForcePasswordRotation marks a user as required to change their
+// password before they can get a session; intended to be called from
+// an admin-only endpoint.
+func (auth *Authentication) ForcePasswordRotation(username string) error {
+	if err := ensurePasswordRotationTable(auth); err != nil {
+		return err
+	}
+	_, err := auth.db.Exec(`
+		INSERT INTO password_rotation (username, forced_at) VALUES (?, ?)
+		ON CONFLICT (username) DO UPDATE SET forced_at = excluded.forced_at`,
+		username, time.Now().Unix())
+	return err
+}
+
+// MustChangePassword reports whether the user must change their
+// password before getting a session: either because ForcePasswordRotation
+// was called for them (and ClearPasswordRotation has not since cleared
+// it), or because their current password is older than LocalAuth's
+// configured PasswordPolicy.MaxAge. authSource is the caller's already-
+// loaded User.AuthSource - callers always have the User in hand by the
+// time they need this check, so it's taken as a parameter rather than
+// re-fetched here.
+func (auth *Authentication) MustChangePassword(username string, authSource AuthSource) (bool, error) {
+	var count int
+	if err := auth.db.Get(&count, `SELECT COUNT(*) FROM password_rotation WHERE username = ?`, username); err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	if auth.LocalAuth == nil || auth.LocalAuth.policy.MaxAge <= 0 || authSource != AuthViaLocalPassword {
+		return false, nil
+	}
+
+	age, err := auth.PasswordAge(username)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return false, err
+		}
+
+		// No password_history row: a local-password account that
+		// predates the password_history table and has never gone
+		// through SetPassword/AddUser since. We can't prove that
+		// password is fresh, so fail closed rather than silently
+		// exempting every pre-existing user from MaxAge until they
+		// happen to change it.
+		return true, nil
+	}
+	return age >= auth.LocalAuth.policy.MaxAge, nil
+}
+
+// ClearPasswordRotation is called by LocalAuthenticator.SetPassword
+// once the user has actually changed their password.
+func (auth *Authentication) ClearPasswordRotation(username string) error {
+	_, err := auth.db.Exec(`DELETE FROM password_rotation WHERE username = ?`, username)
+	return err
+}
+
+// EnforcePasswordRotation is middleware for the Auth/Login chain: if
+// the authenticated user still has a pending forced rotation, it
+// redirects to changePasswordURL instead of letting the request reach
+// onsuccess, so a stale session can't be used to bypass a forced
+// rotation.
+func (auth *Authentication) EnforcePasswordRotation(changePasswordURL string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			user := GetUser(r.Context())
+			if user != nil && !strings.HasPrefix(r.URL.Path, changePasswordURL) {
+				must, err := auth.MustChangePassword(user.Username, user.AuthSource)
+				if err != nil {
+					log.Errorf("auth: could not check password rotation flag for '%s': %s", user.Username, err.Error())
+					http.Redirect(rw, r, changePasswordURL, http.StatusFound)
+					return
+				}
+				if must {
+					http.Redirect(rw, r, changePasswordURL, http.StatusFound)
+					return
+				}
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
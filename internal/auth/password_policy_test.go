@@ -0,0 +1,22 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import "testing"
+
+func TestLoginBackoffDoublesUntilLockout(t *testing.T) {
+	prev := loginBackoff(0)
+	if prev != loginAttemptBaseBackoff {
+		t.Fatalf("loginBackoff(0) = %v, want %v", prev, loginAttemptBaseBackoff)
+	}
+
+	for count := 1; count < loginAttemptLockout; count++ {
+		backoff := loginBackoff(count)
+		if backoff != prev*2 {
+			t.Fatalf("loginBackoff(%d) = %v, want double of loginBackoff(%d) = %v", count, backoff, count-1, prev*2)
+		}
+		prev = backoff
+	}
+}
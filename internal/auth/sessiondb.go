@@ -0,0 +1,391 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ClusterCockpit/cc-backend/pkg/log"
+	"github.com/gorilla/sessions"
+)
+
+// sweepInterval bounds how often the background sweeper checks for
+// expired rows when SessionMaxAge is zero (browser-session cookies).
+const (
+	sweepInterval    = 1 * time.Hour
+	fallbackMaxAge   = 24 * time.Hour
+	sessionIDNumByte = 32
+)
+
+// dbSessionRow mirrors the `sessions` table. Username/roles_json/
+// projects_json/auth_source are kept denormalized out of data_json so
+// ListSessions/RevokeSession can query them directly; data_json carries
+// the full session.Values (which, before a login completes, may hold
+// nothing but a pending WebAuthn/OIDC challenge and no username yet).
+type dbSessionRow struct {
+	ID         string `db:"id"`
+	Username   string `db:"username"`
+	RolesJSON  string `db:"roles_json"`
+	Projects   string `db:"projects_json"`
+	AuthSource int    `db:"auth_source"`
+	DataJSON   string `db:"data_json"`
+	CreatedAt  int64  `db:"created_at"` // Unix seconds
+	ExpiresAt  int64  `db:"expires_at"`
+	LastSeenAt int64  `db:"last_seen_at"`
+	UserAgent  string `db:"user_agent"`
+	RemoteIP   string `db:"remote_ip"`
+}
+
+// SessionInfo is the admin-facing view of a live server-side session.
+type SessionInfo struct {
+	ID         string     `json:"id"`
+	Username   string     `json:"username"`
+	AuthSource AuthSource `json:"authSource"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastSeenAt time.Time  `json:"lastSeenAt"`
+	UserAgent  string     `json:"userAgent"`
+	RemoteIP   string     `json:"remoteIp"`
+}
+
+// DBSessionStore implements gorilla's sessions.Store on top of the
+// `sessions` table instead of encoding session state into the cookie
+// itself. The cookie only ever carries an opaque, HMAC'd session ID, so
+// a revoked or expired row immediately invalidates the session
+// regardless of what the client still presents.
+type DBSessionStore struct {
+	auth    *Authentication
+	hashKey []byte
+	options *sessions.Options
+}
+
+func NewDBSessionStore(auth *Authentication, hashKey []byte) (*DBSessionStore, error) {
+	if _, err := auth.db.Exec(`
+		CREATE TABLE IF NOT EXISTS sessions (
+			id            varchar(255) PRIMARY KEY,
+			username      varchar(255) NOT NULL,
+			roles_json    varchar(255) NOT NULL DEFAULT '',
+			projects_json varchar(255) NOT NULL DEFAULT '',
+			auth_source   int NOT NULL DEFAULT -1,
+			data_json     text NOT NULL DEFAULT '',
+			created_at    bigint NOT NULL,
+			expires_at    bigint NOT NULL,
+			last_seen_at  bigint NOT NULL,
+			user_agent    varchar(255) NOT NULL DEFAULT '',
+			remote_ip     varchar(255) NOT NULL DEFAULT ''
+		)`); err != nil {
+		return nil, err
+	}
+	if _, err := auth.db.Exec(`CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at)`); err != nil {
+		return nil, err
+	}
+
+	store := &DBSessionStore{
+		auth:    auth,
+		hashKey: hashKey,
+		options: &sessions.Options{
+			Path:     "/",
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		},
+	}
+
+	go store.sweepExpired()
+	return store, nil
+}
+
+func (s *DBSessionStore) sweepExpired() {
+	interval := sweepInterval
+	if s.auth.SessionMaxAge > 0 && s.auth.SessionMaxAge < interval {
+		interval = s.auth.SessionMaxAge
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		res, err := s.auth.db.Exec(`DELETE FROM sessions WHERE expires_at < ?`, time.Now().Unix())
+		if err != nil {
+			log.Errorf("auth session sweeper: could not delete expired sessions: %s", err.Error())
+			continue
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			log.Debugf("auth session sweeper: removed %d expired session(s)", n)
+		}
+	}
+}
+
+func (s *DBSessionStore) signID(id string) string {
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(id))
+	sig := mac.Sum(nil)
+	return id + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (s *DBSessionStore) verifyID(cookie string) (string, bool) {
+	idx := len(cookie) - 1
+	for idx >= 0 && cookie[idx] != '.' {
+		idx--
+	}
+	if idx < 0 {
+		return "", false
+	}
+	id, sig := cookie[:idx], cookie[idx+1:]
+
+	mac := hmac.New(sha256.New, s.hashKey)
+	mac.Write([]byte(id))
+	expected := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(sig), []byte(expected)) != 1 {
+		return "", false
+	}
+	return id, true
+}
+
+func newSessionID() (string, error) {
+	raw := make([]byte, sessionIDNumByte)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func (s *DBSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *DBSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	id, ok := s.verifyID(cookie.Value)
+	if !ok {
+		return session, nil
+	}
+
+	var row dbSessionRow
+	if err := s.auth.db.Get(&row,
+		`SELECT id, username, roles_json, projects_json, auth_source, data_json, created_at, expires_at, last_seen_at, user_agent, remote_ip
+		 FROM sessions WHERE id = ?`, id); err != nil {
+		return session, nil
+	}
+
+	if time.Now().After(time.Unix(row.ExpiresAt, 0)) {
+		_, _ = s.auth.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+		return session, nil
+	}
+
+	values, err := decodeValues([]byte(row.DataJSON))
+	if err != nil {
+		log.Warnf("auth session store: could not decode session data for '%s': %s", id, err.Error())
+		return session, nil
+	}
+
+	session.ID = id
+	session.IsNew = false
+	session.Values = values
+
+	if _, err := s.auth.db.Exec(`UPDATE sessions SET last_seen_at = ? WHERE id = ?`, time.Now().Unix(), id); err != nil {
+		log.Warnf("auth session store: could not update last_seen_at: %s", err.Error())
+	}
+
+	return session, nil
+}
+
+func (s *DBSessionStore) Save(r *http.Request, rw http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if _, err := s.auth.db.Exec(`DELETE FROM sessions WHERE id = ?`, session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(rw, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+
+	// username/roles/projects/authSource are only present once a login
+	// has actually completed; before that this row just carries a
+	// pending WebAuthn/OIDC challenge under its own session key.
+	username, _ := session.Values["username"].(string)
+	roles, _ := session.Values["roles"].([]string)
+	projects, _ := session.Values["projects"].([]string)
+	authSource := AuthSource(-1)
+	if raw, ok := session.Values["authSource"].(string); ok {
+		if n, err := strconv.Atoi(raw); err == nil {
+			authSource = AuthSource(n)
+		}
+	}
+
+	rolesJSON, _ := json.Marshal(roles)
+	projectsJSON, _ := json.Marshal(projects)
+	dataJSON, err := encodeValues(session.Values)
+	if err != nil {
+		return err
+	}
+
+	maxAge := s.auth.SessionMaxAge
+	if session.Options.MaxAge != 0 {
+		maxAge = time.Duration(session.Options.MaxAge) * time.Second
+	} else if maxAge == 0 {
+		maxAge = fallbackMaxAge
+	}
+
+	now := time.Now()
+	if _, err := s.auth.db.Exec(`
+		INSERT INTO sessions (id, username, roles_json, projects_json, auth_source, data_json, created_at, expires_at, last_seen_at, user_agent, remote_ip)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			username = excluded.username,
+			roles_json = excluded.roles_json,
+			projects_json = excluded.projects_json,
+			auth_source = excluded.auth_source,
+			data_json = excluded.data_json,
+			expires_at = excluded.expires_at,
+			last_seen_at = excluded.last_seen_at`,
+		session.ID, username, string(rolesJSON), string(projectsJSON), int(authSource), string(dataJSON),
+		now.Unix(), now.Add(maxAge).Unix(), now.Unix(), r.UserAgent(), remoteIP(r)); err != nil {
+		return err
+	}
+
+	http.SetCookie(rw, sessions.NewCookie(session.Name(), s.signID(session.ID), session.Options))
+	return nil
+}
+
+func remoteIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		return fwd
+	}
+	return r.RemoteAddr
+}
+
+// ListSessions returns every live (non-expired) server-side session for
+// a user, most recently active first. Only meaningful when the
+// Authentication was configured with the DB session store.
+func (auth *Authentication) ListSessions(username string) ([]SessionInfo, error) {
+	store, ok := auth.sessionStore.(*DBSessionStore)
+	if !ok {
+		return nil, errors.New("auth: session listing requires the db session store")
+	}
+
+	var rows []dbSessionRow
+	if err := store.auth.db.Select(&rows,
+		`SELECT id, username, roles_json, projects_json, auth_source, created_at, expires_at, last_seen_at, user_agent, remote_ip
+		 FROM sessions WHERE username = ? AND expires_at > ? ORDER BY last_seen_at DESC`,
+		username, time.Now().Unix()); err != nil {
+		return nil, err
+	}
+
+	infos := make([]SessionInfo, 0, len(rows))
+	for _, row := range rows {
+		infos = append(infos, SessionInfo{
+			ID:         row.ID,
+			Username:   row.Username,
+			AuthSource: AuthSource(row.AuthSource),
+			CreatedAt:  time.Unix(row.CreatedAt, 0),
+			ExpiresAt:  time.Unix(row.ExpiresAt, 0),
+			LastSeenAt: time.Unix(row.LastSeenAt, 0),
+			UserAgent:  row.UserAgent,
+			RemoteIP:   row.RemoteIP,
+		})
+	}
+	return infos, nil
+}
+
+// RevokeSession deletes a single server-side session by ID, immediately
+// invalidating whatever cookie a client still holds for it.
+func (auth *Authentication) RevokeSession(id string) error {
+	store, ok := auth.sessionStore.(*DBSessionStore)
+	if !ok {
+		return errors.New("auth: session revocation requires the db session store")
+	}
+
+	_, err := store.auth.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+// RevokeAllForUser deletes every server-side session belonging to a
+// user, e.g. after detecting a compromised account.
+func (auth *Authentication) RevokeAllForUser(username string) error {
+	store, ok := auth.sessionStore.(*DBSessionStore)
+	if !ok {
+		return errors.New("auth: session revocation requires the db session store")
+	}
+
+	_, err := store.auth.db.Exec(`DELETE FROM sessions WHERE username = ?`, username)
+	return err
+}
+
+// encodeValues and decodeValues (de)serialize a gorilla session.Values
+// map to JSON. gorilla types it map[interface{}]interface{} for
+// compatibility with stores that can hold arbitrary Go values, but
+// every key used in this codebase is a string and every value is a
+// string or []string, so a plain JSON round trip is enough and avoids
+// having to gob.Register every concrete type ever stashed in a session.
+func encodeValues(values map[interface{}]interface{}) ([]byte, error) {
+	raw := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		key, ok := k.(string)
+		if !ok {
+			continue
+		}
+		raw[key] = v
+	}
+	return json.Marshal(raw)
+}
+
+func decodeValues(data []byte) (map[interface{}]interface{}, error) {
+	values := make(map[interface{}]interface{})
+	if len(data) == 0 {
+		return values, nil
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	for k, v := range raw {
+		if arr, ok := v.([]interface{}); ok {
+			strs := make([]string, 0, len(arr))
+			allStrings := true
+			for _, e := range arr {
+				s, ok := e.(string)
+				if !ok {
+					allStrings = false
+					break
+				}
+				strs = append(strs, s)
+			}
+			if allStrings {
+				values[k] = strs
+				continue
+			}
+		}
+		values[k] = v
+	}
+	return values, nil
+}
@@ -0,0 +1,41 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import "testing"
+
+func TestDBSessionStoreSignVerifyID(t *testing.T) {
+	store := &DBSessionStore{hashKey: []byte("test-hash-key")}
+
+	cookie := store.signID("some-session-id")
+
+	id, ok := store.verifyID(cookie)
+	if !ok {
+		t.Fatalf("verifyID rejected a cookie it just signed")
+	}
+	if id != "some-session-id" {
+		t.Fatalf("verifyID returned id %q, want %q", id, "some-session-id")
+	}
+}
+
+func TestDBSessionStoreVerifyIDRejectsTampering(t *testing.T) {
+	store := &DBSessionStore{hashKey: []byte("test-hash-key")}
+	cookie := store.signID("some-session-id")
+
+	cases := map[string]string{
+		"different id, same signature": "other-session-id" + cookie[len("some-session-id"):],
+		"wrong key":                    (&DBSessionStore{hashKey: []byte("other-key")}).signID("some-session-id"),
+		"no signature":                 "some-session-id",
+		"empty":                        "",
+	}
+
+	for name, forged := range cases {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := store.verifyID(forged); ok {
+				t.Fatalf("verifyID accepted forged cookie %q", forged)
+			}
+		})
+	}
+}
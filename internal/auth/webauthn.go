@@ -0,0 +1,403 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ClusterCockpit/cc-backend/pkg/log"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// How long a begin-challenge is allowed to sit in the session before
+// the matching finish request must have arrived.
+const webAuthnChallengeTimeout = 5 * time.Minute
+
+const (
+	webAuthnSessionRegister = "webauthn_register"
+	webAuthnSessionLogin    = "webauthn_login"
+)
+
+// webAuthnCredential is what gets persisted in the webauthn_credentials
+// table, keyed to a User.Username.
+type webAuthnCredential struct {
+	Username        string `db:"username"`
+	CredentialID    []byte `db:"credential_id"`
+	PublicKey       []byte `db:"public_key"`
+	AttestationType string `db:"attestation_type"`
+	AAGUID          []byte `db:"aaguid"`
+	SignCount       uint32 `db:"sign_count"`
+	Transports      string `db:"transports"`
+}
+
+// webAuthnChallenge is what gets stashed in the gorilla session between
+// the begin and finish step of registration/login.
+type webAuthnChallenge struct {
+	Username    string `json:"username"`
+	SessionData []byte `json:"sessionData"`
+	ExpiresAt   int64  `json:"expiresAt"`
+}
+
+// webAuthnUser adapts a User plus its stored credentials to the
+// webauthn.User interface expected by github.com/go-webauthn/webauthn.
+type webAuthnUser struct {
+	user        *User
+	credentials []webAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(u.user.Username)
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.user.Name != "" {
+		return u.user.Name
+	}
+	return u.user.Username
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	creds := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		var transports []protocol.AuthenticatorTransport
+		if c.Transports != "" {
+			_ = json.Unmarshal([]byte(c.Transports), &transports)
+		}
+
+		creds = append(creds, webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+			Transport: transports,
+		})
+	}
+	return creds
+}
+
+// WebAuthnAuthenticator lets a User that already has at least one
+// registered FIDO2/passkey credential log in without a password.
+// Registration and login each happen in two HTTP round trips ("begin"
+// and "finish"); the challenge handed out by "begin" is kept in the
+// gorilla session (not in-process memory) so it survives across
+// backend instances and expires after webAuthnChallengeTimeout.
+type WebAuthnAuthenticator struct {
+	auth     *Authentication
+	webauthn *webauthn.WebAuthn
+}
+
+func (wa *WebAuthnAuthenticator) Init(auth *Authentication, conf interface{}) error {
+	wa.auth = auth
+
+	if conf == nil {
+		return errors.New("auth webauthn: missing configuration")
+	}
+
+	config, ok := conf.(map[string]interface{})
+	if !ok {
+		return errors.New("auth webauthn: invalid configuration")
+	}
+
+	rpDisplayName, _ := config["rp_display_name"].(string)
+	rpId, _ := config["rp_id"].(string)
+	rpOrigin, _ := config["rp_origin"].(string)
+	if rpId == "" || rpOrigin == "" {
+		return errors.New("auth webauthn: 'rp_id' and 'rp_origin' are required")
+	}
+
+	w, err := webauthn.New(&webauthn.Config{
+		RPDisplayName: rpDisplayName,
+		RPID:          rpId,
+		RPOrigins:     []string{rpOrigin},
+	})
+	if err != nil {
+		log.Error("Error while initializing authentication -> webauthn.New failed")
+		return err
+	}
+	wa.webauthn = w
+
+	if _, err := wa.auth.db.Exec(`
+		CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			username         varchar(255) NOT NULL,
+			credential_id    blob NOT NULL,
+			public_key       blob NOT NULL,
+			attestation_type varchar(255) NOT NULL,
+			aaguid           blob,
+			sign_count       bigint NOT NULL DEFAULT 0,
+			transports       varchar(255) NOT NULL DEFAULT '',
+			PRIMARY KEY (username, credential_id),
+			FOREIGN KEY (username) REFERENCES user (username) ON DELETE CASCADE
+		)`); err != nil {
+		log.Error("Error while initializing authentication -> creating webauthn_credentials table failed")
+		return err
+	}
+
+	return nil
+}
+
+func (wa *WebAuthnAuthenticator) credentialsForUser(username string) ([]webAuthnCredential, error) {
+	var creds []webAuthnCredential
+	if err := wa.auth.db.Select(&creds,
+		`SELECT username, credential_id, public_key, attestation_type, aaguid, sign_count, transports
+		 FROM webauthn_credentials WHERE username = ?`, username); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// CanLogin is always false: unlike LDAP or local password, WebAuthn has
+// no way to verify an assertion against the plain username/password
+// form that drives the generic Authentication.Login loop, so
+// WebAuthnAuthenticator is never registered in auth.authenticators.
+// The only valid entry points are BeginLogin/FinishLogin below, which
+// verify the signed assertion themselves before establishing a
+// session.
+func (wa *WebAuthnAuthenticator) CanLogin(user *User, rw http.ResponseWriter, r *http.Request) bool {
+	return false
+}
+
+// Login is unreachable (see CanLogin); real verification happens in
+// FinishLogin once the signed assertion has been checked.
+func (wa *WebAuthnAuthenticator) Login(user *User, rw http.ResponseWriter, r *http.Request) (*User, error) {
+	return nil, errors.New("auth webauthn: login must go through BeginLogin/FinishLogin")
+}
+
+func (wa *WebAuthnAuthenticator) putChallenge(r *http.Request, rw http.ResponseWriter, sessionKey string, username string, sessionData *webauthn.SessionData) error {
+	raw, err := json.Marshal(sessionData)
+	if err != nil {
+		return err
+	}
+
+	session, err := wa.auth.sessionStore.Get(r, "session")
+	if err != nil {
+		return err
+	}
+
+	challenge := webAuthnChallenge{
+		Username:    username,
+		SessionData: raw,
+		ExpiresAt:   time.Now().Add(webAuthnChallengeTimeout).Unix(),
+	}
+	challengeRaw, err := json.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+
+	session.Values[sessionKey] = string(challengeRaw)
+	return wa.auth.sessionStore.Save(r, rw, session)
+}
+
+func (wa *WebAuthnAuthenticator) popChallenge(r *http.Request, rw http.ResponseWriter, sessionKey string) (string, *webauthn.SessionData, error) {
+	session, err := wa.auth.sessionStore.Get(r, "session")
+	if err != nil {
+		return "", nil, err
+	}
+
+	raw, ok := session.Values[sessionKey].(string)
+	if !ok {
+		return "", nil, errors.New("auth webauthn: no pending challenge for this session")
+	}
+	delete(session.Values, sessionKey)
+	_ = wa.auth.sessionStore.Save(r, rw, session)
+
+	var challenge webAuthnChallenge
+	if err := json.Unmarshal([]byte(raw), &challenge); err != nil {
+		return "", nil, err
+	}
+
+	if time.Now().Unix() > challenge.ExpiresAt {
+		return "", nil, errors.New("auth webauthn: challenge expired")
+	}
+
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal(challenge.SessionData, &sessionData); err != nil {
+		return "", nil, err
+	}
+
+	return challenge.Username, &sessionData, nil
+}
+
+// BeginRegistration starts registering a new passkey for the user
+// already authenticated on this request (via GetUser(r.Context())) and
+// writes the resulting PublicKeyCredentialCreationOptions as JSON.
+func (wa *WebAuthnAuthenticator) BeginRegistration(rw http.ResponseWriter, r *http.Request) {
+	user := GetUser(r.Context())
+	if user == nil {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	creds, err := wa.credentialsForUser(user.Username)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	options, sessionData, err := wa.webauthn.BeginRegistration(&webAuthnUser{user: user, credentials: creds})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := wa.putChallenge(r, rw, webAuthnSessionRegister, user.Username, sessionData); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(options)
+}
+
+// FinishRegistration verifies the attestation response and persists the
+// new credential for the user that started the registration.
+func (wa *WebAuthnAuthenticator) FinishRegistration(rw http.ResponseWriter, r *http.Request) {
+	user := GetUser(r.Context())
+	if user == nil {
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	username, sessionData, err := wa.popChallenge(r, rw, webAuthnSessionRegister)
+	if err != nil || username != user.Username {
+		http.Error(rw, "no matching registration in progress", http.StatusBadRequest)
+		return
+	}
+
+	creds, err := wa.credentialsForUser(user.Username)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := wa.webauthn.FinishRegistration(&webAuthnUser{user: user, credentials: creds}, *sessionData, r)
+	if err != nil {
+		log.Warnf("auth webauthn: registration failed for '%s': %s", user.Username, err.Error())
+		http.Error(rw, "registration failed", http.StatusBadRequest)
+		return
+	}
+
+	transports, _ := json.Marshal(credential.Transport)
+	if _, err := wa.auth.db.Exec(
+		`INSERT INTO webauthn_credentials (username, credential_id, public_key, attestation_type, aaguid, sign_count, transports)
+		 VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		user.Username, credential.ID, credential.PublicKey, credential.AttestationType,
+		credential.Authenticator.AAGUID, credential.Authenticator.SignCount, string(transports)); err != nil {
+		log.Errorf("auth webauthn: could not store credential for '%s': %s", user.Username, err.Error())
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
+
+// BeginLogin starts a passwordless login for the given username and
+// writes the resulting assertion challenge (with allowCredentials
+// restricted to that user's own credentials) as JSON.
+func (wa *WebAuthnAuthenticator) BeginLogin(rw http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("username")
+	if username == "" {
+		http.Error(rw, "missing username", http.StatusBadRequest)
+		return
+	}
+
+	user, err := wa.auth.GetUser(username)
+	if err != nil {
+		http.Error(rw, "unknown user", http.StatusBadRequest)
+		return
+	}
+
+	creds, err := wa.credentialsForUser(username)
+	if err != nil || len(creds) == 0 {
+		http.Error(rw, "no credentials registered", http.StatusBadRequest)
+		return
+	}
+
+	options, sessionData, err := wa.webauthn.BeginLogin(&webAuthnUser{user: user, credentials: creds})
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := wa.putChallenge(r, rw, webAuthnSessionLogin, username, sessionData); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(options)
+}
+
+// FinishLogin verifies the assertion and, on success, populates the
+// same session values Authentication.Login sets so that a following
+// request hits AuthViaSession exactly as a password login would.
+func (wa *WebAuthnAuthenticator) FinishLogin(rw http.ResponseWriter, r *http.Request) {
+	username, sessionData, err := wa.popChallenge(r, rw, webAuthnSessionLogin)
+	if err != nil {
+		http.Error(rw, "no login in progress", http.StatusBadRequest)
+		return
+	}
+
+	user, err := wa.auth.GetUser(username)
+	if err != nil {
+		http.Error(rw, "unknown user", http.StatusBadRequest)
+		return
+	}
+
+	creds, err := wa.credentialsForUser(username)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := wa.webauthn.FinishLogin(&webAuthnUser{user: user, credentials: creds}, *sessionData, r)
+	if err != nil {
+		log.Warnf("auth webauthn: login failed for '%s': %s", username, err.Error())
+		http.Error(rw, "login failed", http.StatusUnauthorized)
+		return
+	}
+
+	if _, err := wa.auth.db.Exec(
+		`UPDATE webauthn_credentials SET sign_count = ? WHERE username = ? AND credential_id = ?`,
+		credential.Authenticator.SignCount, username, credential.ID); err != nil {
+		log.Warnf("auth webauthn: could not update sign count for '%s': %s", username, err.Error())
+	}
+
+	user.AuthSource = AuthViaWebAuthn
+
+	session, err := wa.auth.sessionStore.New(r, "session")
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if wa.auth.SessionMaxAge != 0 {
+		session.Options.MaxAge = int(wa.auth.SessionMaxAge.Seconds())
+	}
+	session.Values["username"] = user.Username
+	session.Values["projects"] = user.Projects
+	session.Values["roles"] = user.Roles
+	session.Values["authSource"] = strconv.Itoa(int(user.AuthSource))
+	if err := wa.auth.sessionStore.Save(r, rw, session); err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,105 @@
+// Copyright (C) 2023 NHR@FAU, University Erlangen-Nuremberg.
+// All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+)
+
+func newWebAuthnAuthenticatorForTest() *WebAuthnAuthenticator {
+	return &WebAuthnAuthenticator{
+		auth: &Authentication{
+			sessionStore: sessions.NewCookieStore([]byte("01234567890123456789012345678901")),
+		},
+	}
+}
+
+// cookiesFrom copies the Set-Cookie headers off a recorder onto a fresh
+// request, simulating the browser round trip between putChallenge and
+// popChallenge.
+func cookiesFrom(rec *httptest.ResponseRecorder) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+func TestWebAuthnChallengeRoundTrip(t *testing.T) {
+	wa := newWebAuthnAuthenticatorForTest()
+
+	rec := httptest.NewRecorder()
+	sessionData := &webauthn.SessionData{Challenge: "test-challenge"}
+	if err := wa.putChallenge(httptest.NewRequest("GET", "/", nil), rec, webAuthnSessionLogin, "alice", sessionData); err != nil {
+		t.Fatalf("putChallenge: %s", err.Error())
+	}
+
+	username, got, err := wa.popChallenge(cookiesFrom(rec), httptest.NewRecorder(), webAuthnSessionLogin)
+	if err != nil {
+		t.Fatalf("popChallenge: %s", err.Error())
+	}
+	if username != "alice" {
+		t.Fatalf("username = %q, want %q", username, "alice")
+	}
+	if got.Challenge != sessionData.Challenge {
+		t.Fatalf("Challenge = %q, want %q", got.Challenge, sessionData.Challenge)
+	}
+}
+
+func TestWebAuthnPopChallengeIsSingleUse(t *testing.T) {
+	wa := newWebAuthnAuthenticatorForTest()
+
+	rec := httptest.NewRecorder()
+	if err := wa.putChallenge(httptest.NewRequest("GET", "/", nil), rec, webAuthnSessionLogin, "alice", &webauthn.SessionData{}); err != nil {
+		t.Fatalf("putChallenge: %s", err.Error())
+	}
+	req := cookiesFrom(rec)
+
+	if _, _, err := wa.popChallenge(req, httptest.NewRecorder(), webAuthnSessionLogin); err != nil {
+		t.Fatalf("first popChallenge: %s", err.Error())
+	}
+	if _, _, err := wa.popChallenge(req, httptest.NewRecorder(), webAuthnSessionLogin); err == nil {
+		t.Fatal("second popChallenge on the same cookie succeeded; a challenge must be single-use")
+	}
+}
+
+func TestWebAuthnPopChallengeRejectsExpired(t *testing.T) {
+	wa := newWebAuthnAuthenticatorForTest()
+
+	sessionDataRaw, err := json.Marshal(&webauthn.SessionData{})
+	if err != nil {
+		t.Fatalf("marshal session data: %s", err.Error())
+	}
+	challengeRaw, err := json.Marshal(webAuthnChallenge{
+		Username:    "alice",
+		SessionData: sessionDataRaw,
+		ExpiresAt:   time.Now().Add(-time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("marshal challenge: %s", err.Error())
+	}
+
+	putReq := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	session, err := wa.auth.sessionStore.New(putReq, "session")
+	if err != nil {
+		t.Fatalf("sessionStore.New: %s", err.Error())
+	}
+	session.Values[webAuthnSessionLogin] = string(challengeRaw)
+	if err := wa.auth.sessionStore.Save(putReq, rec, session); err != nil {
+		t.Fatalf("sessionStore.Save: %s", err.Error())
+	}
+
+	if _, _, err := wa.popChallenge(cookiesFrom(rec), httptest.NewRecorder(), webAuthnSessionLogin); err == nil {
+		t.Fatal("popChallenge accepted a challenge past its webAuthnChallengeTimeout")
+	}
+}